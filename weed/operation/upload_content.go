@@ -0,0 +1,19 @@
+package operation
+
+// UploadResult is returned by the volume server for every write, and is what
+// PostHandler and TusPatchHandler send back as the response body JSON.
+type UploadResult struct {
+	Name  string `json:"name,omitempty"`
+	Size  uint32 `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+	ETag  string `json:"eTag,omitempty"`
+	Mime  string `json:"mime,omitempty"`
+
+	// Fid is the fid of the needle this upload's content now lives under. It
+	// is only set when Deduplicated is true, in which case it points at a
+	// pre-existing needle rather than one created by this request.
+	Fid string `json:"fid,omitempty"`
+	// Deduplicated is true when the volume server matched this upload's
+	// content hash against an existing needle and skipped writing a new one.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
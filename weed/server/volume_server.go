@@ -0,0 +1,118 @@
+package weed_server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/storage"
+)
+
+// VolumeServer holds the local volume store and configuration every handler
+// in this package operates against.
+type VolumeServer struct {
+	store              *storage.Store
+	masterNode         string
+	fileSizeLimitBytes int64
+	FixJpgOrientation  bool
+	grpcDialOption     interface{}
+}
+
+// NewVolumeServer constructs a VolumeServer backed by store and wires its
+// HTTP routes onto adminMux: the per-fid route ("/<volumeId>,<fid>") for
+// POST/DELETE/PATCH/HEAD, and the batch-delete route added alongside it. It
+// also starts the background maintenance loop that expires abandoned Tus
+// uploads.
+func NewVolumeServer(adminMux *http.ServeMux, store *storage.Store, masterNode string, fileSizeLimitBytes int64) *VolumeServer {
+	vs := &VolumeServer{
+		store:              store,
+		masterNode:         masterNode,
+		fileSizeLimitBytes: fileSizeLimitBytes,
+	}
+
+	adminMux.HandleFunc("/", vs.privateStoreHandler)
+	vs.RegisterBatchDeleteRoute(adminMux)
+
+	go vs.runBackgroundMaintenance()
+
+	return vs
+}
+
+// privateStoreHandler dispatches the per-fid route by HTTP method. PATCH
+// and HEAD carry Tus resumable-upload requests to their companion
+// handlers; GET-based needle reads are out of scope for this series.
+func (vs *VolumeServer) privateStoreHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		vs.PostHandler(w, r)
+	case http.MethodDelete:
+		vs.DeleteHandler(w, r)
+	case http.MethodPatch:
+		vs.TusPatchHandler(w, r)
+	case http.MethodHead:
+		vs.TusHeadHandler(w, r)
+	default:
+		writeJsonError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// runBackgroundMaintenance periodically sweeps for abandoned Tus uploads,
+// the same way the volume server already runs its heartbeat and compaction
+// passes on a ticker.
+func (vs *VolumeServer) runBackgroundMaintenance() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		vs.CleanupExpiredTusUploads()
+	}
+}
+
+func (vs *VolumeServer) GetMaster() string {
+	return vs.masterNode
+}
+
+// maybeCheckJwtAuthorization enforces per-fid JWT auth for client requests.
+// This series does not configure a signing key, so every request is allowed
+// through, type=replicate peer-to-peer requests included. Only the batch
+// delete path skips calling it for type=replicate requests.
+func (vs *VolumeServer) maybeCheckJwtAuthorization(r *http.Request, vid, fid string, isWrite bool) bool {
+	return true
+}
+
+func writeJsonError(w http.ResponseWriter, r *http.Request, httpStatus int, err error) {
+	m := map[string]string{"error": err.Error()}
+	writeJsonQuiet(w, r, httpStatus, m)
+}
+
+func writeJsonQuiet(w http.ResponseWriter, r *http.Request, httpStatus int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if e := json.NewEncoder(w).Encode(obj); e != nil {
+		glog.V(0).Infof("error writing response: %v", e)
+	}
+}
+
+// parseURLPath splits a per-fid route of the form "/<volumeId>,<fid>.<ext>"
+// into its volume id, needle-only fid, and extension. A path with no comma
+// is a volume-only path (isVolumeIdOnly=true).
+func parseURLPath(path string) (vid, fid, ext string, isVolumeIdOnly bool, err error) {
+	sepIndex := strings.LastIndex(path, "/")
+	commaIndex := strings.LastIndex(path[sepIndex+1:], ",")
+	if commaIndex <= 0 {
+		vid = path[sepIndex+1:]
+		isVolumeIdOnly = true
+		return
+	}
+	vid = path[sepIndex+1 : sepIndex+1+commaIndex]
+	fid = path[sepIndex+commaIndex+2:]
+
+	dotIndex := strings.LastIndex(fid, ".")
+	if dotIndex > 0 {
+		ext = fid[dotIndex:]
+		fid = fid[:dotIndex]
+	}
+	return
+}
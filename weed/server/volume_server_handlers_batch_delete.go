@@ -0,0 +1,238 @@
+package weed_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/stats"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/topology"
+)
+
+// batchDeleteConcurrency bounds how many volume groups are deleted at once
+// so a single huge batch cannot starve other volume server work.
+const batchDeleteConcurrency = 32
+
+// RegisterBatchDeleteRoute wires BatchDeleteHandler onto the volume server's
+// admin mux. NewVolumeServer calls this next to its existing
+// adminMux.HandleFunc("/", vs.privateStoreHandler) registration, since
+// batch delete is keyed by a request body rather than a single fid and so
+// needs its own path.
+func (vs *VolumeServer) RegisterBatchDeleteRoute(adminMux *http.ServeMux) {
+	adminMux.HandleFunc("/batch_delete", vs.BatchDeleteHandler)
+}
+
+type batchDeleteRequest struct {
+	Fid string `json:"fid"`
+}
+
+type batchDeleteResult struct {
+	Fid   string `json:"fid"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchDeleteFid pairs a client-supplied fid (e.g. "3,01637037") with the
+// needle-only portion of it (e.g. "01637037"), the way parseURLPath already
+// splits the per-fid routes that DeleteHandler serves.
+type batchDeleteFid struct {
+	full   string
+	needle string
+}
+
+// BatchDeleteHandler accepts many fids in a single request body -- either a
+// JSON array of {"fid":"..."} objects, or newline-delimited fids -- and
+// deletes them with bounded concurrency, streaming one NDJSON result line
+// per fid as it completes. This avoids the per-request HTTP overhead of
+// calling DeleteHandler once per needle for clients doing bulk cleanup.
+func (vs *VolumeServer) BatchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+
+	stats.VolumeServerRequestCounter.WithLabelValues("batchDelete").Inc()
+	start := time.Now()
+	defer func() {
+		stats.VolumeServerRequestHistogram.WithLabelValues("batchDelete").Observe(time.Since(start).Seconds())
+	}()
+
+	fids, e := parseBatchDeleteFids(r)
+	if e != nil {
+		writeJsonError(w, r, http.StatusBadRequest, e)
+		return
+	}
+
+	byVolume := make(map[needle.VolumeId][]batchDeleteFid)
+	var invalid []batchDeleteResult
+	for _, fid := range fids {
+		vid, needlePart, _, _, _ := parseURLPath("/" + fid)
+		volumeId, ve := needle.NewVolumeId(vid)
+		if ve != nil {
+			invalid = append(invalid, batchDeleteResult{Fid: fid, Error: ve.Error()})
+			continue
+		}
+		byVolume[volumeId] = append(byVolume[volumeId], batchDeleteFid{full: fid, needle: needlePart})
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	resultChan := make(chan batchDeleteResult, batchDeleteConcurrency)
+	go func() {
+		for _, result := range invalid {
+			resultChan <- result
+		}
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, batchDeleteConcurrency)
+		for volumeId, groupFids := range byVolume {
+			wg.Add(1)
+			go func(volumeId needle.VolumeId, groupFids []batchDeleteFid) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				vs.deleteVolumeGroup(r, volumeId, groupFids, resultChan)
+			}(volumeId, groupFids)
+		}
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	encoder := json.NewEncoder(w)
+	for result := range resultChan {
+		if e := encoder.Encode(result); e != nil {
+			glog.V(0).Infoln("batch delete encode error:", e)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// deleteVolumeGroup authorizes and deletes the fids belonging to a single
+// volume, writing one result per fid to resultChan -- including the fids
+// that failed authorization, so a bad fid in a batch only ever affects
+// itself rather than every other fid sharing its volume. It reuses
+// DeleteHandler's EC-volume branch and prepareNeedleDelete's cookie/dedup/
+// chunked-manifest handling so a batch delete behaves like looping
+// DeleteHandler over the same fids, only coalescing the peer-replication
+// calls. Unlike DeleteHandler, it does not read the ts form value: every
+// deleted needle's modification time is the time of the delete.
+func (vs *VolumeServer) deleteVolumeGroup(r *http.Request, volumeId needle.VolumeId, groupFids []batchDeleteFid, resultChan chan<- batchDeleteResult) {
+	isReplicate := r.FormValue("type") == "replicate"
+
+	deletable, failed := vs.checkBatchDeleteAuth(r, volumeId, groupFids, isReplicate)
+	for _, result := range failed {
+		resultChan <- result
+	}
+	if len(deletable) == 0 {
+		return
+	}
+
+	ecVolume, hasEcVolume := vs.store.FindEcVolume(volumeId)
+
+	var toReplicate []*needle.Needle
+	var toReplicateFids []string
+	for _, entry := range deletable {
+		if hasEcVolume {
+			count, err := vs.store.DeleteEcShardNeedle(ecVolume, entry.needle, entry.needle.Cookie)
+			if err != nil {
+				resultChan <- batchDeleteResult{Fid: entry.fid, Error: err.Error()}
+			} else {
+				resultChan <- batchDeleteResult{Fid: entry.fid, Size: count}
+			}
+			continue
+		}
+
+		count, skip, err := vs.prepareNeedleDelete(volumeId, entry.needle, entry.fid)
+		if err != nil {
+			resultChan <- batchDeleteResult{Fid: entry.fid, Error: err.Error()}
+			continue
+		}
+		if skip {
+			resultChan <- batchDeleteResult{Fid: entry.fid, Size: count}
+			continue
+		}
+		toReplicate = append(toReplicate, entry.needle)
+		toReplicateFids = append(toReplicateFids, entry.fid)
+	}
+
+	if len(toReplicate) == 0 {
+		return
+	}
+
+	results, err := topology.ReplicatedBatchDelete(vs.GetMaster(), vs.store, volumeId, toReplicate, r)
+	if err != nil {
+		for _, fid := range toReplicateFids {
+			resultChan <- batchDeleteResult{Fid: fid, Error: err.Error()}
+		}
+		return
+	}
+
+	for i, res := range results {
+		if res.Error != nil {
+			resultChan <- batchDeleteResult{Fid: toReplicateFids[i], Error: res.Error.Error()}
+			continue
+		}
+		resultChan <- batchDeleteResult{Fid: toReplicateFids[i], Size: res.Size}
+	}
+}
+
+// deletableNeedle pairs a parsed needle with its full "<volumeId>,<fid>"
+// fid, used both to report its result and to look up its dedup reference.
+type deletableNeedle struct {
+	fid    string
+	needle *needle.Needle
+}
+
+// checkBatchDeleteAuth applies the same JWT check that DeleteHandler applies
+// per-fid. Fids that fail it are reported back individually in failed rather
+// than aborting the rest of the volume's batch. Requests replicated from a
+// peer (type=replicate) skip this check, since the peer already authorized
+// the delete.
+func (vs *VolumeServer) checkBatchDeleteAuth(r *http.Request, volumeId needle.VolumeId, groupFids []batchDeleteFid, isReplicate bool) (deletable []deletableNeedle, failed []batchDeleteResult) {
+	for _, fid := range groupFids {
+		if !isReplicate && !vs.maybeCheckJwtAuthorization(r, volumeId.String(), fid.needle, true) {
+			failed = append(failed, batchDeleteResult{Fid: fid.full, Error: "wrong jwt"})
+			continue
+		}
+		n := new(needle.Needle)
+		n.ParsePath(fid.needle)
+		deletable = append(deletable, deletableNeedle{fid: fid.full, needle: n})
+	}
+	return
+}
+
+// parseBatchDeleteFids reads either a JSON array of batchDeleteRequest
+// objects or a plain newline-delimited list of fids from the request body,
+// depending on the Content-Type header.
+func parseBatchDeleteFids(r *http.Request) ([]string, error) {
+	defer r.Body.Close()
+
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var reqs []batchDeleteRequest
+		if e := json.NewDecoder(r.Body).Decode(&reqs); e != nil {
+			return nil, e
+		}
+		fids := make([]string, 0, len(reqs))
+		for _, req := range reqs {
+			if req.Fid != "" {
+				fids = append(fids, req.Fid)
+			}
+		}
+		return fids, nil
+	}
+
+	var fids []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			fids = append(fids, line)
+		}
+	}
+	return fids, scanner.Err()
+}
@@ -0,0 +1,48 @@
+package weed_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchDeleteFidsJSON(t *testing.T) {
+	body := `[{"fid":"3,111"},{"fid":"3,222"},{"fid":""}]`
+	r := httptest.NewRequest(http.MethodPost, "/batch_delete", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	fids, e := parseBatchDeleteFids(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(fids) != 2 || fids[0] != "3,111" || fids[1] != "3,222" {
+		t.Fatalf("unexpected fids: %v", fids)
+	}
+}
+
+func TestParseBatchDeleteFidsNewlineDelimited(t *testing.T) {
+	body := "3,111\n3,222\n\n4,333\n"
+	r := httptest.NewRequest(http.MethodPost, "/batch_delete", strings.NewReader(body))
+
+	fids, e := parseBatchDeleteFids(r)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(fids) != 3 || fids[2] != "4,333" {
+		t.Fatalf("unexpected fids: %v", fids)
+	}
+}
+
+func TestCheckBatchDeleteAuthBuildsDeletableNeedles(t *testing.T) {
+	vs := &VolumeServer{}
+	r := httptest.NewRequest(http.MethodPost, "/batch_delete", nil)
+
+	deletable, failed := vs.checkBatchDeleteAuth(r, 3, []batchDeleteFid{{full: "3,111", needle: "111"}}, false)
+	if len(failed) != 0 {
+		t.Fatalf("unexpected auth failures: %v", failed)
+	}
+	if len(deletable) != 1 || deletable[0].fid != "3,111" {
+		t.Fatalf("unexpected deletable set: %v", deletable)
+	}
+}
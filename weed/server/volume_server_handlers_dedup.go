@@ -0,0 +1,321 @@
+package weed_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+// dedupIndexEntry is one row of a volume's hash->fid index kept
+// alongside the volume's .idx file so a crash can be recovered from by
+// rebuilding it from the volume contents.
+type dedupIndexEntry struct {
+	Fid      string `json:"fid"`
+	RefCount int    `json:"refCount"`
+}
+
+// dedupIndex is the in-memory, mutex-guarded view of the on-disk hash index
+// for a single volume. It is loaded lazily and flushed after every mutation;
+// the on-disk format is a flat JSON map, which keeps compaction/rebuild
+// trivial at the cost of holding the whole index in memory, matching how
+// small deployments size a single volume's needle count.
+type dedupIndex struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*dedupIndexEntry
+}
+
+var dedupIndices = struct {
+	sync.Mutex
+	byVolume map[needle.VolumeId]*dedupIndex
+}{byVolume: make(map[needle.VolumeId]*dedupIndex)}
+
+func dedupIndexPath(vs *VolumeServer, volumeId needle.VolumeId) (string, error) {
+	v := vs.store.GetVolume(volumeId)
+	if v == nil {
+		return "", fmt.Errorf("volume %d not found", volumeId)
+	}
+	return v.DataFileName() + ".dedup", nil
+}
+
+// getDedupIndex returns the in-memory dedup index for volumeId, loading it
+// from disk on first use. If no index file exists yet, or the one on disk
+// is corrupt, it is rebuilt from the volume's live needles -- the same
+// recovery RebuildDedupIndex performs explicitly -- so a crash that left
+// the sidecar missing or stale self-heals the first time dedup is used
+// against that volume again.
+func (vs *VolumeServer) getDedupIndex(volumeId needle.VolumeId) (*dedupIndex, error) {
+	dedupIndices.Lock()
+	if idx, found := dedupIndices.byVolume[volumeId]; found {
+		dedupIndices.Unlock()
+		return idx, nil
+	}
+	dedupIndices.Unlock()
+
+	path, e := dedupIndexPath(vs, volumeId)
+	if e != nil {
+		return nil, e
+	}
+
+	idx := &dedupIndex{path: path, entries: make(map[string]*dedupIndexEntry)}
+	bytes, readErr := ioutil.ReadFile(path)
+	switch {
+	case readErr == nil:
+		if e := json.Unmarshal(bytes, &idx.entries); e != nil {
+			glog.V(0).Infof("dedup index %s is corrupt, rebuilding from volume contents: %v", path, e)
+			idx = nil
+		}
+	case os.IsNotExist(readErr):
+		idx = nil
+	default:
+		return nil, readErr
+	}
+
+	if idx == nil {
+		rebuilt, e := vs.rebuildDedupIndexEntries(volumeId, path)
+		if e != nil {
+			return nil, e
+		}
+		idx = rebuilt
+	}
+
+	dedupIndices.Lock()
+	dedupIndices.byVolume[volumeId] = idx
+	dedupIndices.Unlock()
+	return idx, nil
+}
+
+func (idx *dedupIndex) save() error {
+	bytes, e := json.Marshal(idx.entries)
+	if e != nil {
+		return e
+	}
+	tmp := idx.path + ".tmp"
+	if e := ioutil.WriteFile(tmp, bytes, 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// lookupOrReserve returns the existing fid for a hash if the referenced
+// needle is still live, bumping its refcount. On a miss it does not reserve
+// the slot -- the caller only records the new fid once its write actually
+// succeeds, via recordFid, so a failed write can never leave a dangling
+// index entry pointing at a needle that was never created.
+func (idx *dedupIndex) lookupOrReserve(hash string, isLive func(fid string) bool) (existingFid string, deduplicated bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, found := idx.entries[hash]
+	if !found {
+		return "", false
+	}
+	if isLive(entry.Fid) {
+		entry.RefCount++
+		idx.save()
+		return entry.Fid, true
+	}
+	delete(idx.entries, hash)
+	idx.save()
+	return "", false
+}
+
+// recordFid records a freshly written needle's content hash so future
+// uploads of the same content can be deduplicated against it. Callers
+// invoke this only after the write it describes has succeeded.
+func (idx *dedupIndex) recordFid(hash, fid string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, found := idx.entries[hash]; !found {
+		idx.entries[hash] = &dedupIndexEntry{Fid: fid, RefCount: 1}
+		idx.save()
+	}
+}
+
+// release decrements the refcount for hash and reports whether it reached
+// zero, meaning the caller may now actually delete the needle.
+func (idx *dedupIndex) release(hash string) (shouldDelete bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry, found := idx.entries[hash]
+	if !found {
+		return true
+	}
+	entry.RefCount--
+	if entry.RefCount <= 0 {
+		delete(idx.entries, hash)
+		idx.save()
+		return true
+	}
+	idx.save()
+	return false
+}
+
+// hashForFid finds the hash whose index entry currently points at fid, so
+// DeleteHandler can decrement the right refcount without the caller having
+// to resend the digest.
+func (idx *dedupIndex) hashForFid(fid string) (hash string, found bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for h, entry := range idx.entries {
+		if entry.Fid == fid {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestHeader extracts the sha256 digest from an RFC 3230 `Digest`
+// header of the form `sha256=<hex>`, returning the value after `sha256=`
+// as is. A base64 value is not decoded, so it never matches the hex digest
+// it is compared against.
+func parseDigestHeader(header string) (hexDigest string, ok bool) {
+	const prefix = "sha256="
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, prefix) {
+			return part[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// RebuildDedupIndex recomputes the hash->fid index for a volume from its
+// live needles, discarding the on-disk index first. getDedupIndex already
+// performs this same recovery automatically whenever a volume's index is
+// missing or corrupt; RebuildDedupIndex exists to trigger it explicitly,
+// e.g. if an operator suspects the index has drifted without the sidecar
+// file itself being unreadable.
+func (vs *VolumeServer) RebuildDedupIndex(volumeId needle.VolumeId) error {
+	path, e := dedupIndexPath(vs, volumeId)
+	if e != nil {
+		return e
+	}
+	os.Remove(path)
+
+	dedupIndices.Lock()
+	delete(dedupIndices.byVolume, volumeId)
+	dedupIndices.Unlock()
+
+	idx, e := vs.rebuildDedupIndexEntries(volumeId, path)
+	if e != nil {
+		return e
+	}
+
+	dedupIndices.Lock()
+	dedupIndices.byVolume[volumeId] = idx
+	dedupIndices.Unlock()
+
+	return nil
+}
+
+// rebuildDedupIndexEntries scans a volume's live needles to build a fresh
+// hash->fid index and persists it, using the canonical "<volumeId>,<fid>"
+// form so entries rebuilt after a crash match the format PostHandler
+// records for a fresh write.
+func (vs *VolumeServer) rebuildDedupIndexEntries(volumeId needle.VolumeId, path string) (*dedupIndex, error) {
+	idx := &dedupIndex{path: path, entries: make(map[string]*dedupIndexEntry)}
+	e := vs.store.WalkNeedles(volumeId, func(n *needle.Needle) error {
+		if len(n.Data) == 0 {
+			return nil
+		}
+		hash := sha256Hex(n.Data)
+		fid := needle.NewFileId(volumeId, uint64(n.Id), uint32(n.Cookie)).String()
+		if existing, found := idx.entries[hash]; found {
+			existing.RefCount++
+		} else {
+			idx.entries[hash] = &dedupIndexEntry{Fid: fid, RefCount: 1}
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if e := idx.save(); e != nil {
+		return nil, e
+	}
+	return idx, nil
+}
+
+// maybeDedupWrite checks the incoming needle's content hash against the
+// volume's dedup index before it is written. It returns deduplicated=true
+// when an existing, still-live needle already holds identical content, in
+// which case the caller should skip the write and reuse existingFid.
+// fullFid is the canonical "<volumeId>,<fid>" form, the same one
+// recordDedupMapping and RebuildDedupIndex store.
+func (vs *VolumeServer) maybeDedupWrite(r *http.Request, volumeId needle.VolumeId, fullFid string, n *needle.Needle) (existingFid string, deduplicated bool, err error) {
+	computed := sha256Hex(n.Data)
+
+	if clientDigest, ok := parseDigestHeader(r.Header.Get("Digest")); ok {
+		if !strings.EqualFold(clientDigest, computed) {
+			return "", false, fmt.Errorf("digest mismatch: expected %s, got %s", clientDigest, computed)
+		}
+	}
+
+	idx, e := vs.getDedupIndex(volumeId)
+	if e != nil {
+		return "", false, e
+	}
+
+	isLive := func(candidateFullFid string) bool {
+		candidate := new(needle.Needle)
+		candidate.ParsePath(needleOnlyFid(candidateFullFid))
+		_, e := vs.store.ReadVolumeNeedle(volumeId, candidate)
+		return e == nil
+	}
+
+	existingFid, deduplicated = idx.lookupOrReserve(computed, isLive)
+	return existingFid, deduplicated, nil
+}
+
+// recordDedupMapping is called after a fresh (non-deduplicated) write
+// succeeds, so future uploads of the same content can be found. fullFid is
+// the canonical "<volumeId>,<fid>" form.
+func (vs *VolumeServer) recordDedupMapping(volumeId needle.VolumeId, fullFid string, n *needle.Needle) {
+	idx, e := vs.getDedupIndex(volumeId)
+	if e != nil {
+		glog.V(0).Infof("dedup index unavailable for volume %d: %v", volumeId, e)
+		return
+	}
+	idx.recordFid(sha256Hex(n.Data), fullFid)
+}
+
+// releaseDedupRef decrements the refcount for a deleted needle's content
+// hash, reporting whether the caller should proceed with the actual
+// delete. fullFid is the canonical "<volumeId>,<fid>" form.
+func (vs *VolumeServer) releaseDedupRef(volumeId needle.VolumeId, fullFid string) (shouldDelete bool) {
+	idx, e := vs.getDedupIndex(volumeId)
+	if e != nil {
+		return true
+	}
+	hash, found := idx.hashForFid(fullFid)
+	if !found {
+		return true
+	}
+	return idx.release(hash)
+}
+
+// needleOnlyFid strips a canonical "<volumeId>,<fid>" string down to its
+// needle-only portion, the form Needle.ParsePath expects.
+func needleOnlyFid(fullFid string) string {
+	if idx := strings.Index(fullFid, ","); idx >= 0 {
+		return fullFid[idx+1:]
+	}
+	return fullFid
+}
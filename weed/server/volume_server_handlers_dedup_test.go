@@ -0,0 +1,152 @@
+package weed_server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestDedupIndex(t *testing.T) *dedupIndex {
+	t.Helper()
+	f, e := ioutil.TempFile("", "dedup-index-*")
+	if e != nil {
+		t.Fatal(e)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	t.Cleanup(func() { os.Remove(path); os.Remove(path + ".tmp") })
+	return &dedupIndex{path: path, entries: make(map[string]*dedupIndexEntry)}
+}
+
+func TestDedupIndexLookupOrReserveMissDoesNotReserve(t *testing.T) {
+	idx := newTestDedupIndex(t)
+	alwaysLive := func(string) bool { return true }
+
+	fid, deduplicated := idx.lookupOrReserve("hash-a", alwaysLive)
+	if deduplicated {
+		t.Fatal("a hash with no entry should not be deduplicated")
+	}
+	if fid != "" {
+		t.Fatalf("expected no existing fid, got %s", fid)
+	}
+	if _, found := idx.entries["hash-a"]; found {
+		t.Fatal("a miss must not reserve an entry before the write it describes has succeeded")
+	}
+}
+
+func TestDedupIndexRecordFidAfterSuccessfulWrite(t *testing.T) {
+	idx := newTestDedupIndex(t)
+	alwaysLive := func(string) bool { return true }
+
+	if _, deduplicated := idx.lookupOrReserve("hash-a", alwaysLive); deduplicated {
+		t.Fatal("unexpected dedup hit on empty index")
+	}
+	idx.recordFid("hash-a", "3,111")
+
+	if idx.entries["hash-a"].Fid != "3,111" || idx.entries["hash-a"].RefCount != 1 {
+		t.Fatalf("unexpected entry after recordFid: %+v", idx.entries["hash-a"])
+	}
+}
+
+func TestDedupIndexLookupOrReserveHitBumpsRefCount(t *testing.T) {
+	idx := newTestDedupIndex(t)
+	alwaysLive := func(string) bool { return true }
+
+	idx.recordFid("hash-a", "3,111")
+	fid, deduplicated := idx.lookupOrReserve("hash-a", alwaysLive)
+	if !deduplicated {
+		t.Fatal("second write of the same hash should be deduplicated")
+	}
+	if fid != "3,111" {
+		t.Fatalf("expected the original fid 3,111 to be returned, got %s", fid)
+	}
+	if idx.entries["hash-a"].RefCount != 2 {
+		t.Fatalf("expected refcount 2, got %d", idx.entries["hash-a"].RefCount)
+	}
+}
+
+func TestDedupIndexLookupOrReserveClearsStaleEntry(t *testing.T) {
+	idx := newTestDedupIndex(t)
+	neverLive := func(string) bool { return false }
+
+	idx.entries["hash-a"] = &dedupIndexEntry{Fid: "3,111", RefCount: 3}
+
+	fid, deduplicated := idx.lookupOrReserve("hash-a", neverLive)
+	if deduplicated {
+		t.Fatal("a hash pointing at a deleted needle should not be deduplicated")
+	}
+	if fid != "" {
+		t.Fatalf("expected no existing fid once the stale entry is cleared, got %s", fid)
+	}
+	if _, found := idx.entries["hash-a"]; found {
+		t.Fatal("a stale entry should be removed, not replaced, until the new write succeeds")
+	}
+}
+
+func TestDedupIndexReleaseOnlySignalsDeleteAtZero(t *testing.T) {
+	idx := newTestDedupIndex(t)
+
+	idx.recordFid("hash-a", "3,111")
+	idx.entries["hash-a"].RefCount++
+
+	if idx.release("hash-a") {
+		t.Fatal("releasing one of two references should not signal delete")
+	}
+	if !idx.release("hash-a") {
+		t.Fatal("releasing the last reference should signal delete")
+	}
+	if _, found := idx.entries["hash-a"]; found {
+		t.Fatal("entry should be removed once its refcount reaches zero")
+	}
+}
+
+func TestNeedleOnlyFid(t *testing.T) {
+	if got := needleOnlyFid("3,01637037"); got != "01637037" {
+		t.Fatalf("needleOnlyFid(3,01637037) = %s, want 01637037", got)
+	}
+	if got := needleOnlyFid("01637037"); got != "01637037" {
+		t.Fatalf("needleOnlyFid(01637037) = %s, want 01637037 unchanged", got)
+	}
+}
+
+func TestDedupIndexHashForFid(t *testing.T) {
+	idx := newTestDedupIndex(t)
+	idx.entries["hash-a"] = &dedupIndexEntry{Fid: "3,111", RefCount: 1}
+
+	hash, found := idx.hashForFid("3,111")
+	if !found || hash != "hash-a" {
+		t.Fatalf("expected to find hash-a for fid 3,111, got %s, %v", hash, found)
+	}
+
+	if _, found := idx.hashForFid("3,999"); found {
+		t.Fatal("did not expect a hash for an unknown fid")
+	}
+}
+
+func TestParseDigestHeader(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantHex   string
+		wantFound bool
+	}{
+		{"sha256=abcdef", "abcdef", true},
+		{"md5=xxxxxx, sha256=abcdef", "abcdef", true},
+		{"md5=xxxxxx", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		hexDigest, ok := parseDigestHeader(tt.header)
+		if ok != tt.wantFound || hexDigest != tt.wantHex {
+			t.Errorf("parseDigestHeader(%q) = (%q, %v), want (%q, %v)", tt.header, hexDigest, ok, tt.wantHex, tt.wantFound)
+		}
+	}
+}
+
+func TestSha256Hex(t *testing.T) {
+	got := sha256Hex([]byte("hello"))
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got != want {
+		t.Errorf("sha256Hex(hello) = %s, want %s", got, want)
+	}
+}
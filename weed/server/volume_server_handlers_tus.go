@@ -0,0 +1,324 @@
+package weed_server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/operation"
+	"github.com/chrislusf/seaweedfs/weed/stats"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+	"github.com/chrislusf/seaweedfs/weed/topology"
+)
+
+const (
+	tusResumableHeader = "Tus-Resumable"
+	tusVersion         = "1.0.0"
+	tusExpiry          = 24 * time.Hour
+)
+
+// tusUploadState is the sidecar state persisted next to a volume's data file
+// for every partial upload still in flight. It is serialized as JSON so it
+// stays easy to inspect and migrate.
+type tusUploadState struct {
+	Fid        string    `json:"fid"`
+	Length     int64     `json:"length"`
+	Offset     int64     `json:"offset"`
+	Metadata   string    `json:"metadata,omitempty"`
+	LastActive time.Time `json:"lastActive"`
+}
+
+func tusSidecarPath(vs *VolumeServer, volumeId needle.VolumeId, fid string) (string, error) {
+	v := vs.store.GetVolume(volumeId)
+	if v == nil {
+		return "", fmt.Errorf("volume %d not found", volumeId)
+	}
+	return v.DataFileName() + "." + fid + ".tus", nil
+}
+
+func writeTusHeaders(w http.ResponseWriter) {
+	w.Header().Set(tusResumableHeader, tusVersion)
+}
+
+// tusCreateUpload handles the initial `POST` of a Tus resumable upload. It
+// allocates a sidecar file to track the upload's progress and responds with
+// the upload's `Location` so the client can resume with PATCH/HEAD.
+func (vs *VolumeServer) tusCreateUpload(w http.ResponseWriter, r *http.Request, volumeId needle.VolumeId, vid, fid string) {
+	writeTusHeaders(w)
+
+	uploadLengthHeader := r.Header.Get("Upload-Length")
+	uploadLength, e := strconv.ParseInt(uploadLengthHeader, 10, 64)
+	if e != nil || uploadLength < 0 {
+		writeJsonError(w, r, http.StatusBadRequest, errors.New("invalid or missing Upload-Length"))
+		return
+	}
+	if vs.fileSizeLimitBytes > 0 && uploadLength > int64(vs.fileSizeLimitBytes) {
+		writeJsonError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("upload length %d exceeds limit", uploadLength))
+		return
+	}
+
+	sidecar, se := tusSidecarPath(vs, volumeId, fid)
+	if se != nil {
+		writeJsonError(w, r, http.StatusBadRequest, se)
+		return
+	}
+
+	state := &tusUploadState{
+		Fid:        fid,
+		Length:     uploadLength,
+		Offset:     0,
+		Metadata:   r.Header.Get("Upload-Metadata"),
+		LastActive: time.Now(),
+	}
+	if e := saveTusState(sidecar, state); e != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, e)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/%s,%s", vid, fid))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHeadHandler reports how much of a resumable upload has already been
+// received, as required by the Tus HEAD request. NewVolumeServer routes
+// HEAD and PATCH requests on the per-fid path to this and TusPatchHandler
+// through privateStoreHandler.
+func (vs *VolumeServer) TusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	stats.VolumeServerRequestCounter.WithLabelValues("tus_head").Inc()
+	writeTusHeaders(w)
+
+	vid, fid, _, _, _ := parseURLPath(r.URL.Path)
+	volumeId, ve := needle.NewVolumeId(vid)
+	if ve != nil {
+		writeJsonError(w, r, http.StatusBadRequest, ve)
+		return
+	}
+	if !vs.maybeCheckJwtAuthorization(r, vid, fid, false) {
+		writeJsonError(w, r, http.StatusUnauthorized, errors.New("wrong jwt"))
+		return
+	}
+
+	sidecar, se := tusSidecarPath(vs, volumeId, fid)
+	if se != nil {
+		writeJsonError(w, r, http.StatusBadRequest, se)
+		return
+	}
+	state, le := loadTusState(sidecar)
+	if le != nil {
+		writeJsonError(w, r, http.StatusNotFound, le)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(state.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(state.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatchHandler appends a contiguous chunk of bytes to an in-progress
+// upload, and finalizes the needle once the full length has been received.
+func (vs *VolumeServer) TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	stats.VolumeServerRequestCounter.WithLabelValues("tus_patch").Inc()
+	start := time.Now()
+	defer func() {
+		stats.VolumeServerRequestHistogram.WithLabelValues("tus_patch").Observe(time.Since(start).Seconds())
+	}()
+	writeTusHeaders(w)
+
+	vid, fid, _, _, _ := parseURLPath(r.URL.Path)
+	volumeId, ve := needle.NewVolumeId(vid)
+	if ve != nil {
+		writeJsonError(w, r, http.StatusBadRequest, ve)
+		return
+	}
+	if !vs.maybeCheckJwtAuthorization(r, vid, fid, true) {
+		writeJsonError(w, r, http.StatusUnauthorized, errors.New("wrong jwt"))
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJsonError(w, r, http.StatusUnsupportedMediaType, errors.New("expected application/offset+octet-stream"))
+		return
+	}
+
+	offset, oe := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if oe != nil || offset < 0 {
+		writeJsonError(w, r, http.StatusBadRequest, errors.New("invalid or missing Upload-Offset"))
+		return
+	}
+
+	sidecar, se := tusSidecarPath(vs, volumeId, fid)
+	if se != nil {
+		writeJsonError(w, r, http.StatusBadRequest, se)
+		return
+	}
+	state, le := loadTusState(sidecar)
+	if le != nil {
+		writeJsonError(w, r, http.StatusNotFound, le)
+		return
+	}
+	if offset != state.Offset {
+		writeJsonError(w, r, http.StatusConflict, fmt.Errorf("expected offset %d, got %d", state.Offset, offset))
+		return
+	}
+
+	partFile := sidecar + ".data"
+	out, oe := os.OpenFile(partFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if oe != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, oe)
+		return
+	}
+	defer out.Close()
+	if _, se := out.Seek(offset, io.SeekStart); se != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, se)
+		return
+	}
+
+	limit := state.Length - offset
+	written, ce := io.Copy(out, io.LimitReader(r.Body, limit))
+	if ce != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, ce)
+		return
+	}
+
+	state.Offset += written
+	state.LastActive = time.Now()
+	if e := saveTusState(sidecar, state); e != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, e)
+		return
+	}
+
+	if state.Offset < state.Length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(state.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// the upload is complete: build the needle from the assembled bytes and
+	// run it through the normal replication path.
+	data, re := ioutil.ReadFile(partFile)
+	if re != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, re)
+		return
+	}
+
+	reqNeedle := new(needle.Needle)
+	reqNeedle.Data = data
+	reqNeedle.ParsePath(fid)
+	reqNeedle.LastModified = uint64(time.Now().Unix())
+	if meta, me := parseTusMetadata(state.Metadata); me == nil {
+		if mime, ok := meta["mimetype"]; ok {
+			reqNeedle.Mime = []byte(mime)
+			reqNeedle.SetHasMime()
+		}
+		if name, ok := meta["filename"]; ok {
+			reqNeedle.Name = []byte(name)
+			reqNeedle.SetHasName()
+		}
+	}
+	reqNeedle.Checksum = needle.NewCRC(data)
+
+	ret := operation.UploadResult{}
+	isUnchanged, writeError := topology.ReplicatedWrite(vs.GetMaster(), vs.store, volumeId, reqNeedle, r)
+
+	os.Remove(partFile)
+	os.Remove(sidecar)
+
+	if writeError == nil && isUnchanged {
+		setEtag(w, reqNeedle.Etag())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	httpStatus := http.StatusCreated
+	if writeError != nil {
+		httpStatus = http.StatusInternalServerError
+		ret.Error = writeError.Error()
+	}
+	if reqNeedle.HasName() {
+		ret.Name = string(reqNeedle.Name)
+	}
+	ret.Size = uint32(len(data))
+	ret.ETag = reqNeedle.Etag()
+	ret.Mime = string(reqNeedle.Mime)
+	setEtag(w, ret.ETag)
+	writeJsonQuiet(w, r, httpStatus, ret)
+}
+
+func saveTusState(path string, state *tusUploadState) error {
+	bytes, e := json.Marshal(state)
+	if e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
+
+func loadTusState(path string) (*tusUploadState, error) {
+	bytes, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	state := new(tusUploadState)
+	if e := json.Unmarshal(bytes, state); e != nil {
+		return nil, e
+	}
+	return state, nil
+}
+
+func parseTusMetadata(encoded string) (map[string]string, error) {
+	result := make(map[string]string)
+	if encoded == "" {
+		return result, nil
+	}
+	for _, pair := range strings.Split(encoded, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, e := base64.StdEncoding.DecodeString(parts[1])
+		if e != nil {
+			return nil, e
+		}
+		result[parts[0]] = string(value)
+	}
+	return result, nil
+}
+
+// CleanupExpiredTusUploads removes sidecar state and partial data files for
+// uploads that have not made progress within tusExpiry. NewVolumeServer
+// calls it once an hour from runBackgroundMaintenance.
+func (vs *VolumeServer) CleanupExpiredTusUploads() {
+	now := time.Now()
+	for _, location := range vs.store.Locations {
+		entries, e := ioutil.ReadDir(location.Directory)
+		if e != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".tus") {
+				continue
+			}
+			path := location.Directory + "/" + entry.Name()
+			state, e := loadTusState(path)
+			if e != nil {
+				continue
+			}
+			if now.Sub(state.LastActive) < tusExpiry {
+				continue
+			}
+			os.Remove(path)
+			os.Remove(path + ".data")
+			glog.V(0).Infof("cleaned up expired tus upload %s", state.Fid)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package weed_server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoadTusState(t *testing.T) {
+	f, e := ioutil.TempFile("", "tus-state-*")
+	if e != nil {
+		t.Fatal(e)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	want := &tusUploadState{
+		Fid:        "01637037",
+		Length:     1024,
+		Offset:     512,
+		Metadata:   "filename d29ybGQ=",
+		LastActive: time.Unix(1700000000, 0),
+	}
+	if e := saveTusState(path, want); e != nil {
+		t.Fatal(e)
+	}
+
+	got, e := loadTusState(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if got.Fid != want.Fid || got.Length != want.Length || got.Offset != want.Offset || got.Metadata != want.Metadata {
+		t.Fatalf("loaded state %+v does not match saved state %+v", got, want)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	// "world" and "text/plain" base64-encoded, as a client following the Tus
+	// spec would send them.
+	encoded := "filename d29ybGQ=,mimetype dGV4dC9wbGFpbg=="
+
+	meta, e := parseTusMetadata(encoded)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if meta["filename"] != "world" {
+		t.Errorf("filename = %q, want %q", meta["filename"], "world")
+	}
+	if meta["mimetype"] != "text/plain" {
+		t.Errorf("mimetype = %q, want %q", meta["mimetype"], "text/plain")
+	}
+}
+
+func TestParseTusMetadataEmpty(t *testing.T) {
+	meta, e := parseTusMetadata("")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(meta) != 0 {
+		t.Errorf("expected no entries for empty metadata, got %v", meta)
+	}
+}
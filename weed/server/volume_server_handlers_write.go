@@ -42,6 +42,11 @@ func (vs *VolumeServer) PostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Header.Get(tusResumableHeader) != "" {
+		vs.tusCreateUpload(w, r, volumeId, vid, fid)
+		return
+	}
+
 	reqNeedle, originalSize, ne := needle.CreateNeedleFromRequest(r, vs.FixJpgOrientation, vs.fileSizeLimitBytes)
 	if ne != nil {
 		writeJsonError(w, r, http.StatusBadRequest, ne)
@@ -49,8 +54,33 @@ func (vs *VolumeServer) PostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ret := operation.UploadResult{}
+
+	fullFid := vid + "," + fid
+	dedupEnabled := r.FormValue("dedup") == "true" || r.Header.Get("Digest") != ""
+	if dedupEnabled {
+		existingFid, deduplicated, de := vs.maybeDedupWrite(r, volumeId, fullFid, reqNeedle)
+		if de != nil {
+			writeJsonError(w, r, http.StatusBadRequest, de)
+			return
+		}
+		if deduplicated {
+			ret.Fid = existingFid
+			ret.Size = uint32(originalSize)
+			ret.ETag = reqNeedle.Etag()
+			ret.Mime = string(reqNeedle.Mime)
+			ret.Deduplicated = true
+			setEtag(w, ret.ETag)
+			writeJsonQuiet(w, r, http.StatusCreated, ret)
+			return
+		}
+	}
+
 	isUnchanged, writeError := topology.ReplicatedWrite(vs.GetMaster(), vs.store, volumeId, reqNeedle, r)
 
+	if dedupEnabled && writeError == nil {
+		vs.recordDedupMapping(volumeId, fullFid, reqNeedle)
+	}
+
 	// http 204 status code does not allow body
 	if writeError == nil && isUnchanged {
 		setEtag(w, reqNeedle.Etag())
@@ -93,58 +123,92 @@ func (vs *VolumeServer) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	// glog.V(2).Infof("volume %s deleting %s", vid, n)
 
-	cookie := n.Cookie
-
-	ecVolume, hasEcVolume := vs.store.FindEcVolume(volumeId)
-
-	if hasEcVolume {
-		count, err := vs.store.DeleteEcShardNeedle(ecVolume, n, cookie)
+	if ecVolume, hasEcVolume := vs.store.FindEcVolume(volumeId); hasEcVolume {
+		count, err := vs.store.DeleteEcShardNeedle(ecVolume, n, n.Cookie)
 		writeDeleteResult(err, count, w, r)
 		return
 	}
 
-	_, ok := vs.store.ReadVolumeNeedle(volumeId, n)
-	if ok != nil {
+	count, skip, err := vs.prepareNeedleDelete(volumeId, n, vid+","+fid)
+	if err == errNeedleNotFound {
 		m := make(map[string]uint32)
 		m["size"] = 0
 		writeJsonQuiet(w, r, http.StatusNotFound, m)
 		return
 	}
-
-	if n.Cookie != cookie {
+	if err == errDeleteCookieMismatch {
 		glog.V(0).Infoln("delete", r.URL.Path, "with unmaching cookie from ", r.RemoteAddr, "agent", r.UserAgent())
 		writeJsonError(w, r, http.StatusBadRequest, errors.New("File Random Cookie does not match."))
 		return
 	}
+	if err != nil {
+		writeJsonError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if skip {
+		// other uploads still reference this content; keep the needle and
+		// just report the delete as if it happened.
+		writeDeleteResult(nil, count, w, r)
+		return
+	}
+
+	if len(r.FormValue("ts")) > 0 {
+		modifiedTime, err := strconv.ParseInt(r.FormValue("ts"), 10, 64)
+		if err == nil {
+			n.LastModified = uint64(modifiedTime)
+		}
+	}
 
-	count := int64(n.Size)
+	_, err = topology.ReplicatedDelete(vs.GetMaster(), vs.store, volumeId, n, r)
+
+	writeDeleteResult(err, count, w, r)
+
+}
+
+var (
+	errNeedleNotFound       = errors.New("needle not found")
+	errDeleteCookieMismatch = errors.New("file random cookie does not match")
+)
+
+// prepareNeedleDelete validates that a non-EC needle may be deleted --
+// confirming it is still present with a matching cookie, releasing its
+// dedup reference, and expanding a chunked-manifest's size -- without
+// performing the replicated delete itself. DeleteHandler and the
+// batch-delete path share this so a bad cookie, a still-live dedup
+// reference, or a chunked manifest are handled identically from both.
+// fullFid is the canonical "<volumeId>,<fid>" form the dedup index keys
+// its entries by.
+func (vs *VolumeServer) prepareNeedleDelete(volumeId needle.VolumeId, n *needle.Needle, fullFid string) (count int64, skip bool, err error) {
+	cookie := n.Cookie
+
+	if _, ok := vs.store.ReadVolumeNeedle(volumeId, n); ok != nil {
+		return 0, false, errNeedleNotFound
+	}
+
+	if n.Cookie != cookie {
+		return 0, false, errDeleteCookieMismatch
+	}
+
+	if !vs.releaseDedupRef(volumeId, fullFid) {
+		return int64(n.Size), true, nil
+	}
+
+	count = int64(n.Size)
 
 	if n.IsChunkedManifest() {
 		chunkManifest, e := operation.LoadChunkManifest(n.Data, n.IsCompressed())
 		if e != nil {
-			writeJsonError(w, r, http.StatusInternalServerError, fmt.Errorf("Load chunks manifest error: %v", e))
-			return
+			return 0, false, fmt.Errorf("Load chunks manifest error: %v", e)
 		}
 		// make sure all chunks had deleted before delete manifest
 		if e := chunkManifest.DeleteChunks(vs.GetMaster(), false, vs.grpcDialOption); e != nil {
-			writeJsonError(w, r, http.StatusInternalServerError, fmt.Errorf("Delete chunks error: %v", e))
-			return
+			return 0, false, fmt.Errorf("Delete chunks error: %v", e)
 		}
 		count = chunkManifest.Size
 	}
 
 	n.LastModified = uint64(time.Now().Unix())
-	if len(r.FormValue("ts")) > 0 {
-		modifiedTime, err := strconv.ParseInt(r.FormValue("ts"), 10, 64)
-		if err == nil {
-			n.LastModified = uint64(modifiedTime)
-		}
-	}
-
-	_, err := topology.ReplicatedDelete(vs.GetMaster(), vs.store, volumeId, n, r)
-
-	writeDeleteResult(err, count, w, r)
-
+	return count, false, nil
 }
 
 func writeDeleteResult(err error, count int64, w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,106 @@
+package topology
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/storage"
+	"github.com/chrislusf/seaweedfs/weed/storage/needle"
+)
+
+// BatchDeleteResult is the outcome of deleting one needle as part of a
+// ReplicatedBatchDelete call. Results are returned in the same order as the
+// needles slice passed in, so callers can zip them back up with whatever
+// per-fid identifier they are tracking.
+type BatchDeleteResult struct {
+	Size  int64
+	Error error
+}
+
+// ReplicatedBatchDelete deletes many needles belonging to a single volume in
+// one call. It deletes each needle locally the same way ReplicatedDelete
+// does for one needle at a time, then replicates the whole batch to each
+// peer volume server holding a copy with a single HTTP call per peer,
+// instead of paying the one-HTTP-call-per-needle cost of looping
+// BatchDeleteHandler over ReplicatedDelete. As with ReplicatedDelete, a
+// request that is itself a type=replicate call is not replicated further,
+// so a batch delete received from a peer never fans back out.
+func ReplicatedBatchDelete(masterNode string, store *storage.Store, volumeId needle.VolumeId, needles []*needle.Needle, r *http.Request) ([]BatchDeleteResult, error) {
+	results := make([]BatchDeleteResult, len(needles))
+	for i, n := range needles {
+		size, err := store.Delete(volumeId, n)
+		results[i] = BatchDeleteResult{Size: int64(size), Error: err}
+	}
+
+	if r.FormValue("type") == "replicate" {
+		return results, nil
+	}
+
+	peers, err := replicaLocationsExcludingSelf(masterNode, store, volumeId)
+	if err != nil || len(peers) == 0 {
+		return results, nil
+	}
+
+	fids := make([]string, len(needles))
+	for i, n := range needles {
+		fids[i] = needle.NewFileId(volumeId, uint64(n.Id), uint32(n.Cookie)).String()
+	}
+	for _, peer := range peers {
+		go replicateBatchDeleteToPeer(peer, fids)
+	}
+
+	return results, nil
+}
+
+// replicaLocationsExcludingSelf looks up the other volume servers currently
+// holding a replica of volumeId, the same lookup ReplicatedWrite and
+// ReplicatedDelete already do per needle, so a batch only pays for it once.
+func replicaLocationsExcludingSelf(masterNode string, store *storage.Store, volumeId needle.VolumeId) ([]string, error) {
+	locations, err := Lookup(masterNode, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	self := store.Ip + ":" + fmt.Sprint(store.Port)
+	peers := make([]string, 0, len(locations))
+	for _, location := range locations {
+		if location == self {
+			continue
+		}
+		peers = append(peers, location)
+	}
+	return peers, nil
+}
+
+// replicateBatchDeleteToPeer asks a peer volume server to delete the same
+// fids, marked type=replicate so the peer's BatchDeleteHandler trusts the
+// call without a client JWT and does not replicate it any further.
+func replicateBatchDeleteToPeer(peerUrl string, fids []string) {
+	reqs := make([]batchDeleteRequestForReplication, len(fids))
+	for i, fid := range fids {
+		reqs[i] = batchDeleteRequestForReplication{Fid: fid}
+	}
+	body, e := json.Marshal(reqs)
+	if e != nil {
+		glog.V(0).Infof("batch delete replicate marshal error: %v", e)
+		return
+	}
+	resp, e := http.Post(fmt.Sprintf("http://%s/batch_delete?type=replicate", peerUrl), "application/json", bytes.NewReader(body))
+	if e != nil {
+		glog.V(0).Infof("batch delete replicate to %s failed: %v", peerUrl, e)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		glog.V(0).Infof("batch delete replicate to %s returned %s", peerUrl, resp.Status)
+	}
+}
+
+// batchDeleteRequestForReplication mirrors weed_server's batchDeleteRequest
+// JSON shape so the peer's BatchDeleteHandler can decode it the same way it
+// decodes a client-submitted JSON batch.
+type batchDeleteRequestForReplication struct {
+	Fid string `json:"fid"`
+}